@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/voc/rtmp-auth/storage"
+)
+
+// Backend is the persistence layer Store delegates to. Store calls it once
+// per changed stream or setting; sqliteBackend writes just that row, while
+// fileBackend still rewrites its whole file on every mutation.
+type Backend interface {
+	// Load reads the full state at startup, generating and persisting a
+	// new Secret if none exists yet.
+	Load() (storage.State, error)
+	UpsertStream(stream *storage.Stream) error
+	DeleteStream(id string) error
+	SetActive(id string, active bool) error
+	SetBlocked(id string, blocked bool) error
+	SetCtrlUrl(url string) error
+	SetApiTokens(tokens []string) error
+}
+
+// NewBackend picks a Backend implementation based on dsn's scheme:
+// file://path for the original protobuf-on-disk format (unchanged, for
+// migration) or sqlite://path for the SQLite-backed store.
+func NewBackend(dsn string) (Backend, error) {
+	switch {
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return NewSqliteBackend(strings.TrimPrefix(dsn, "sqlite://"))
+	case strings.HasPrefix(dsn, "file://"):
+		return NewFileBackend(strings.TrimPrefix(dsn, "file://"))
+	case dsn != "":
+		// No scheme given, assume a plain file path for backward compatibility
+		// with the old -store flag.
+		return NewFileBackend(dsn)
+	default:
+		return nil, fmt.Errorf("NewBackend: empty storage DSN")
+	}
+}
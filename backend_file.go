@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/voc/rtmp-auth/storage"
+)
+
+// fileBackend is the original protobuf-on-disk backend: every mutation
+// rewrites the whole file, which is fine for the small number of streams
+// this project was originally built for.
+type fileBackend struct {
+	path  string
+	state storage.State
+	sync.Mutex
+}
+
+// NewFileBackend returns a backend for the protobuf-encoded store file at
+// path. The file is not touched until Load, which reads it or creates it.
+func NewFileBackend(path string) (*fileBackend, error) {
+	return &fileBackend{path: path}, nil
+}
+
+func (b *fileBackend) Load() (storage.State, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	data, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return storage.State{}, fmt.Errorf("No previous file read: %v", err)
+		}
+		// Non-existing state is ok
+	} else {
+		if err := proto.Unmarshal(data, &b.state); err != nil {
+			return storage.State{}, fmt.Errorf("Failed to parse stream state: %v", err)
+		}
+		log.Println("State restored from", b.path)
+	}
+
+	if len(b.state.Secret) == 0 {
+		b.state.Secret = make([]byte, 32)
+		rand.Read(b.state.Secret)
+		if err := b.save(); err != nil {
+			return storage.State{}, err
+		}
+	}
+
+	return b.state, nil
+}
+
+func (b *fileBackend) UpsertStream(stream *storage.Stream) error {
+	b.Lock()
+	defer b.Unlock()
+
+	for i, s := range b.state.Streams {
+		if s.Id == stream.Id {
+			b.state.Streams[i] = stream
+			return b.save()
+		}
+	}
+	b.state.Streams = append(b.state.Streams, stream)
+	return b.save()
+}
+
+func (b *fileBackend) DeleteStream(id string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	for i, s := range b.state.Streams {
+		if s.Id == id {
+			b.state.Streams = append(b.state.Streams[:i], b.state.Streams[i+1:]...)
+			break
+		}
+	}
+	return b.save()
+}
+
+func (b *fileBackend) SetActive(id string, active bool) error {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, s := range b.state.Streams {
+		if s.Id == id {
+			s.Active = active
+			break
+		}
+	}
+	return b.save()
+}
+
+func (b *fileBackend) SetBlocked(id string, blocked bool) error {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, s := range b.state.Streams {
+		if s.Id == id {
+			s.Blocked = blocked
+			break
+		}
+	}
+	return b.save()
+}
+
+func (b *fileBackend) SetCtrlUrl(url string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.state.CtrlUrl = url
+	return b.save()
+}
+
+func (b *fileBackend) SetApiTokens(tokens []string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.state.ApiTokens = tokens
+	return b.save()
+}
+
+// save writes the whole state to a timestamped tmp file and renames it
+// into place. Requires Lock.
+func (b *fileBackend) save() error {
+	out, err := proto.Marshal(&b.state)
+	if err != nil {
+		return fmt.Errorf("Failed to encode state: %v", err)
+	}
+	tmp := fmt.Sprintf(b.path+".%v", time.Now())
+	if err := ioutil.WriteFile(tmp, out, 0600); err != nil {
+		return fmt.Errorf("Failed to write state: %v", err)
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return fmt.Errorf("Failed to move state: %v", err)
+	}
+	return nil
+}
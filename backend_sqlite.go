@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/voc/rtmp-auth/storage"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS streams (
+	id TEXT PRIMARY KEY,
+	application TEXT NOT NULL,
+	name TEXT NOT NULL,
+	auth_key TEXT NOT NULL,
+	auth_expire INTEGER NOT NULL,
+	notes TEXT NOT NULL,
+	blocked INTEGER NOT NULL,
+	active INTEGER NOT NULL,
+	lease_expire INTEGER NOT NULL DEFAULT 0,
+	lease_token TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS state (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+`
+
+// sqliteBackend is a pure-Go (no cgo, via modernc.org/sqlite) backend that
+// persists each mutation as a single row write/delete instead of rewriting
+// the whole store file, unlike fileBackend.
+type sqliteBackend struct {
+	db *sql.DB
+}
+
+// NewSqliteBackend opens (or creates) a SQLite database at path and
+// ensures its schema exists.
+func NewSqliteBackend(path string) (*sqliteBackend, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open sqlite backend: %v", err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return nil, fmt.Errorf("Failed to migrate sqlite schema: %v", err)
+	}
+	return &sqliteBackend{db: db}, nil
+}
+
+func (b *sqliteBackend) Load() (storage.State, error) {
+	var state storage.State
+
+	rows, err := b.db.Query(
+		`SELECT id, application, name, auth_key, auth_expire, notes, blocked, active, lease_expire, lease_token FROM streams`)
+	if err != nil {
+		return state, fmt.Errorf("Failed to load streams: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		stream := &storage.Stream{}
+		if err := rows.Scan(&stream.Id, &stream.Application, &stream.Name, &stream.AuthKey,
+			&stream.AuthExpire, &stream.Notes, &stream.Blocked, &stream.Active,
+			&stream.LeaseExpire, &stream.LeaseToken); err != nil {
+			return state, fmt.Errorf("Failed to scan stream row: %v", err)
+		}
+		state.Streams = append(state.Streams, stream)
+	}
+
+	state.CtrlUrl, _ = b.getString("ctrl_url")
+	if tokens, err := b.getString("api_tokens"); err == nil {
+		state.ApiTokens = splitNonEmpty(tokens)
+	}
+	secret, err := b.getBytes("secret")
+	if err != nil {
+		return state, err
+	}
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		if err := b.setBytes("secret", secret); err != nil {
+			return state, err
+		}
+	}
+	state.Secret = secret
+
+	return state, nil
+}
+
+func (b *sqliteBackend) UpsertStream(stream *storage.Stream) error {
+	_, err := b.db.Exec(`
+		INSERT INTO streams (id, application, name, auth_key, auth_expire, notes, blocked, active, lease_expire, lease_token)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			application=excluded.application, name=excluded.name, auth_key=excluded.auth_key,
+			auth_expire=excluded.auth_expire, notes=excluded.notes, blocked=excluded.blocked,
+			active=excluded.active, lease_expire=excluded.lease_expire, lease_token=excluded.lease_token`,
+		stream.Id, stream.Application, stream.Name, stream.AuthKey, stream.AuthExpire,
+		stream.Notes, stream.Blocked, stream.Active, stream.LeaseExpire, stream.LeaseToken)
+	if err != nil {
+		return fmt.Errorf("Failed to upsert stream %v: %v", stream.Id, err)
+	}
+	return nil
+}
+
+func (b *sqliteBackend) DeleteStream(id string) error {
+	if _, err := b.db.Exec(`DELETE FROM streams WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("Failed to delete stream %v: %v", id, err)
+	}
+	return nil
+}
+
+func (b *sqliteBackend) SetActive(id string, active bool) error {
+	if _, err := b.db.Exec(`UPDATE streams SET active = ? WHERE id = ?`, active, id); err != nil {
+		return fmt.Errorf("Failed to set active for stream %v: %v", id, err)
+	}
+	return nil
+}
+
+func (b *sqliteBackend) SetBlocked(id string, blocked bool) error {
+	if _, err := b.db.Exec(`UPDATE streams SET blocked = ? WHERE id = ?`, blocked, id); err != nil {
+		return fmt.Errorf("Failed to set blocked for stream %v: %v", id, err)
+	}
+	return nil
+}
+
+func (b *sqliteBackend) SetCtrlUrl(url string) error {
+	return b.setString("ctrl_url", url)
+}
+
+func (b *sqliteBackend) SetApiTokens(tokens []string) error {
+	return b.setString("api_tokens", strings.Join(tokens, ","))
+}
+
+// Ping proves the database is reachable by writing and removing a
+// throwaway row, satisfying healthProber for /healthz.
+func (b *sqliteBackend) Ping() error {
+	const key = "__healthz_probe__"
+	if err := b.setString(key, "1"); err != nil {
+		return err
+	}
+	_, err := b.db.Exec(`DELETE FROM state WHERE key = ?`, key)
+	return err
+}
+
+// Close closes the underlying database handle, satisfying closer for
+// graceful shutdown.
+func (b *sqliteBackend) Close() error {
+	return b.db.Close()
+}
+
+func (b *sqliteBackend) getString(key string) (string, error) {
+	var value string
+	err := b.db.QueryRow(`SELECT value FROM state WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (b *sqliteBackend) setString(key, value string) error {
+	_, err := b.db.Exec(`INSERT INTO state (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value=excluded.value`, key, value)
+	if err != nil {
+		return fmt.Errorf("Failed to set %v: %v", key, err)
+	}
+	return nil
+}
+
+func (b *sqliteBackend) getBytes(key string) ([]byte, error) {
+	value, err := b.getString(key)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
+func (b *sqliteBackend) setBytes(key string, value []byte) error {
+	return b.setString(key, base64.StdEncoding.EncodeToString(value))
+}
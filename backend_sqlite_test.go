@@ -0,0 +1,81 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/voc/rtmp-auth/storage"
+)
+
+func TestSqliteBackendRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+
+	b, err := NewSqliteBackend(path)
+	if err != nil {
+		t.Fatalf("NewSqliteBackend: %v", err)
+	}
+	defer b.Close()
+
+	state, err := b.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(state.Secret) != 32 {
+		t.Fatalf("expected Load to generate a 32-byte secret, got %d bytes", len(state.Secret))
+	}
+	if len(state.Streams) != 0 {
+		t.Fatalf("expected a fresh backend to have no streams, got %d", len(state.Streams))
+	}
+
+	stream := &storage.Stream{
+		Id: "s1", Application: "live", Name: "foo",
+		AuthKey: "key", AuthExpire: -1, Notes: "n",
+	}
+	if err := b.UpsertStream(stream); err != nil {
+		t.Fatalf("UpsertStream: %v", err)
+	}
+
+	reloaded, err := b.Load()
+	if err != nil {
+		t.Fatalf("Load after upsert: %v", err)
+	}
+	if len(reloaded.Streams) != 1 || reloaded.Streams[0].Id != "s1" {
+		t.Fatalf("expected stream s1 to round-trip, got %+v", reloaded.Streams)
+	}
+
+	if err := b.SetActive("s1", true); err != nil {
+		t.Fatalf("SetActive: %v", err)
+	}
+	if err := b.SetBlocked("s1", true); err != nil {
+		t.Fatalf("SetBlocked: %v", err)
+	}
+	reloaded, err = b.Load()
+	if err != nil {
+		t.Fatalf("Load after SetActive/SetBlocked: %v", err)
+	}
+	if !reloaded.Streams[0].Active || !reloaded.Streams[0].Blocked {
+		t.Fatalf("expected SetActive/SetBlocked to persist, got %+v", reloaded.Streams[0])
+	}
+
+	if err := b.SetCtrlUrl("http://nginx"); err != nil {
+		t.Fatalf("SetCtrlUrl: %v", err)
+	}
+	reloaded, err = b.Load()
+	if err != nil {
+		t.Fatalf("Load after SetCtrlUrl: %v", err)
+	}
+	if reloaded.CtrlUrl != "http://nginx" {
+		t.Fatalf("expected SetCtrlUrl to persist, got %q", reloaded.CtrlUrl)
+	}
+
+	if err := b.DeleteStream("s1"); err != nil {
+		t.Fatalf("DeleteStream: %v", err)
+	}
+	reloaded, err = b.Load()
+	if err != nil {
+		t.Fatalf("Load after delete: %v", err)
+	}
+	if len(reloaded.Streams) != 0 {
+		t.Fatalf("expected stream to be deleted, got %+v", reloaded.Streams)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// leaseDuration is how long a publisher is trusted to keep streaming
+// without calling /refresh before it is considered a zombie and dropped.
+const leaseDuration = 5 * time.Minute
+
+func newLeaseToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// GrantLease starts a fresh lease for a newly authorized publisher,
+// returning the refresh token the publisher must present to /refresh to
+// keep the lease alive. AuthExpire remains the hard upper bound regardless
+// of how often the lease is refreshed.
+func (store *Store) GrantLease(id string) (token string, err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, stream := range store.State.Streams {
+		if stream.Id == id {
+			token, err = newLeaseToken()
+			if err != nil {
+				return "", err
+			}
+			stream.LeaseToken = token
+			stream.LeaseExpire = time.Now().Add(leaseDuration).Unix()
+			if err := store.backend.UpsertStream(stream); err != nil {
+				return "", fmt.Errorf("Couldn't save lease for Stream %v (%v/%v)", id, stream.Application, stream.Name)
+			}
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("GrantLease failed: Stream id %v not found.", id)
+}
+
+// RefreshLease extends a stream's lease by leaseDuration if token matches
+// the lease token issued by GrantLease.
+func (store *Store) RefreshLease(id string, token string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, stream := range store.State.Streams {
+		if stream.Id == id {
+			if stream.LeaseToken == "" || stream.LeaseToken != token {
+				return fmt.Errorf("RefreshLease failed: Stream id %v invalid refresh token.", id)
+			}
+			stream.LeaseExpire = time.Now().Add(leaseDuration).Unix()
+			return store.backend.UpsertStream(stream)
+		}
+	}
+	return fmt.Errorf("RefreshLease failed: Stream id %v not found.", id)
+}
+
+// RevokeLease clears a stream's lease, e.g. on a clean unpublish, so
+// ExpireLeases doesn't try to drop a publisher that already went away.
+func (store *Store) RevokeLease(id string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, stream := range store.State.Streams {
+		if stream.Id == id {
+			stream.LeaseToken = ""
+			stream.LeaseExpire = 0
+			return store.backend.UpsertStream(stream)
+		}
+	}
+	return fmt.Errorf("RevokeLease failed: Stream id %v not found.", id)
+}
+
+// RevokeLeaseByAppName clears the lease for any stream matching app/name,
+// used by UnpublishHandler so a clean unpublish doesn't linger until
+// ExpireLeases notices the lease ran out.
+func (store *Store) RevokeLeaseByAppName(app string, name string) {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, stream := range store.State.Streams {
+		if stream.Application == app && stream.Name == name {
+			stream.LeaseToken = ""
+			stream.LeaseExpire = 0
+			store.backend.UpsertStream(stream)
+		}
+	}
+}
+
+// ExpireLeases drops publishers whose lease ran out without being
+// refreshed, cleaning up zombie publishers whose TCP connection hangs
+// without nginx noticing. Unlike Expire, it does not remove the stream
+// itself - AuthExpire is still the authority on that.
+func (store *Store) ExpireLeases() {
+	var toDrop []string
+	now := time.Now().Unix()
+
+	store.RLock()
+	for _, stream := range store.State.Streams {
+		if stream.Active && stream.LeaseExpire != 0 && stream.LeaseExpire < now {
+			log.Printf("Lease expired for %s/%s, dropping publisher\n", stream.Application, stream.Name)
+			toDrop = append(toDrop, stream.Id)
+		}
+	}
+	store.RUnlock()
+
+	for _, id := range toDrop {
+		if err := ReqDropStreamPublisher(store, id); err != nil {
+			log.Println(err)
+		}
+		store.RevokeLease(id)
+	}
+}
+
+// RefreshHandler handles POST /refresh, extending a publisher's lease so
+// the background ExpireLeases goroutine doesn't drop it.
+func RefreshHandler(store *Store) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			log.Println("Failed to parse refresh data:", err)
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		id := r.PostForm.Get("lease_id")
+		token := r.PostForm.Get("refresh_token")
+
+		if err := store.RefreshLease(id, token); err != nil {
+			log.Println("RefreshHandler:", err)
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		log.Printf("Lease refreshed for stream %v\n", id)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/voc/rtmp-auth/storage"
+)
+
+// memBackend is a minimal in-memory Backend used by tests so they don't
+// depend on disk or sqlite I/O. If failAfter is non-zero, the failAfter'th
+// UpsertStream/DeleteStream call returns an error, to exercise rollback
+// paths.
+type memBackend struct {
+	streams   map[string]*storage.Stream
+	ctrlUrl   string
+	apiTokens []string
+	calls     int
+	failAfter int
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{streams: make(map[string]*storage.Stream)}
+}
+
+func (b *memBackend) Load() (storage.State, error) {
+	return storage.State{}, nil
+}
+
+func (b *memBackend) maybeFail() error {
+	b.calls++
+	if b.failAfter != 0 && b.calls == b.failAfter {
+		return fmt.Errorf("memBackend: simulated failure on call %d", b.calls)
+	}
+	return nil
+}
+
+func (b *memBackend) UpsertStream(stream *storage.Stream) error {
+	if err := b.maybeFail(); err != nil {
+		return err
+	}
+	cp := *stream
+	b.streams[stream.Id] = &cp
+	return nil
+}
+
+func (b *memBackend) DeleteStream(id string) error {
+	if err := b.maybeFail(); err != nil {
+		return err
+	}
+	delete(b.streams, id)
+	return nil
+}
+
+func (b *memBackend) SetActive(id string, active bool) error {
+	if s, ok := b.streams[id]; ok {
+		s.Active = active
+	}
+	return nil
+}
+
+func (b *memBackend) SetBlocked(id string, blocked bool) error {
+	if s, ok := b.streams[id]; ok {
+		s.Blocked = blocked
+	}
+	return nil
+}
+
+func (b *memBackend) SetCtrlUrl(url string) error {
+	b.ctrlUrl = url
+	return nil
+}
+
+func (b *memBackend) SetApiTokens(tokens []string) error {
+	b.apiTokens = tokens
+	return nil
+}
+
+func TestGrantAndRefreshLease(t *testing.T) {
+	backend := newMemBackend()
+	stream := &storage.Stream{Id: "s1", Application: "live", Name: "foo"}
+	backend.streams["s1"] = stream
+	store := &Store{State: storage.State{Streams: []*storage.Stream{stream}}, backend: backend}
+
+	token, err := store.GrantLease("s1")
+	if err != nil {
+		t.Fatalf("GrantLease: %v", err)
+	}
+	if token == "" {
+		t.Fatal("expected a non-empty lease token")
+	}
+	if stream.LeaseExpire <= time.Now().Unix() {
+		t.Fatalf("expected LeaseExpire to be in the future, got %v", stream.LeaseExpire)
+	}
+
+	if err := store.RefreshLease("s1", "wrong-token"); err == nil {
+		t.Fatal("expected RefreshLease to reject a mismatched token")
+	}
+
+	if err := store.RefreshLease("s1", token); err != nil {
+		t.Fatalf("RefreshLease: %v", err)
+	}
+	if stream.LeaseExpire <= time.Now().Unix() {
+		t.Fatalf("expected RefreshLease to keep LeaseExpire in the future, got %v", stream.LeaseExpire)
+	}
+}
+
+func TestRevokeLease(t *testing.T) {
+	backend := newMemBackend()
+	stream := &storage.Stream{Id: "s1", Application: "live", Name: "foo"}
+	backend.streams["s1"] = stream
+	store := &Store{State: storage.State{Streams: []*storage.Stream{stream}}, backend: backend}
+
+	if _, err := store.GrantLease("s1"); err != nil {
+		t.Fatalf("GrantLease: %v", err)
+	}
+	if err := store.RevokeLease("s1"); err != nil {
+		t.Fatalf("RevokeLease: %v", err)
+	}
+	if stream.LeaseToken != "" || stream.LeaseExpire != 0 {
+		t.Fatalf("expected RevokeLease to clear the lease, got token=%q expire=%v", stream.LeaseToken, stream.LeaseExpire)
+	}
+}
+
+func TestExpireLeasesDropsZombiePublisher(t *testing.T) {
+	backend := newMemBackend()
+	stream := &storage.Stream{
+		Id: "s1", Application: "live", Name: "foo",
+		Active: true, LeaseExpire: time.Now().Add(-time.Minute).Unix(), LeaseToken: "stale",
+	}
+	backend.streams["s1"] = stream
+	// No CtrlUrl configured, so ReqDropStreamPublisher fails fast without
+	// making a network call - ExpireLeases should still revoke the lease.
+	store := &Store{State: storage.State{Streams: []*storage.Stream{stream}}, backend: backend}
+
+	store.ExpireLeases()
+
+	if stream.LeaseToken != "" || stream.LeaseExpire != 0 {
+		t.Fatalf("expected ExpireLeases to revoke the zombie lease, got token=%q expire=%v", stream.LeaseToken, stream.LeaseExpire)
+	}
+}
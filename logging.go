@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// LogConfig configures the structured event logger set up in main().
+type LogConfig struct {
+	Format     string // "text" (default) or "json"
+	File       string
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+}
+
+// eventLogger emits one structured record per stream lifecycle event, in
+// addition to the regular operational log.Printf calls. Defaults to a
+// human-readable text handler on stderr until InitLogger is called.
+var eventLogger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// InitLogger sets up eventLogger per cfg, optionally routing it through a
+// lumberjack rotating writer so operators can ship the file to ELK/Loki
+// without external cron rotation.
+func InitLogger(cfg LogConfig) {
+	var out io.Writer = os.Stderr
+	if cfg.File != "" {
+		out = &lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAgeDays,
+		}
+	}
+
+	var handler slog.Handler
+	if cfg.Format == "json" {
+		handler = slog.NewJSONHandler(out, nil)
+	} else {
+		handler = slog.NewTextHandler(out, nil)
+	}
+	eventLogger = slog.New(handler)
+}
+
+// logEvent emits a structured record for one of the stream lifecycle
+// events: publish_ok, publish_denied, unpublish, stream_added,
+// stream_removed, stream_blocked.
+func logEvent(event, app, name, streamId string, r *http.Request, reason string) {
+	eventLogger.Info(event,
+		"event", event,
+		"app", app,
+		"name", name,
+		"stream_id", streamId,
+		"remote_addr", remoteAddr(r),
+		"reason", reason,
+		"user", logUser(r),
+	)
+}
+
+func remoteAddr(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	return r.RemoteAddr
+}
@@ -2,17 +2,14 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"regexp"
-	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/csrf"
@@ -20,279 +17,41 @@ import (
 	"github.com/rakyll/statik/fs"
 
 	_ "github.com/voc/rtmp-auth/statik"
-	"github.com/voc/rtmp-auth/storage"
 )
 
-type handleFunc func(http.ResponseWriter, *http.Request)
-
-var durationRegex = regexp.MustCompile(`P([\d\.]+Y)?([\d\.]+M)?([\d\.]+D)?T?([\d\.]+H)?([\d\.]+M)?([\d\.]+?S)?`)
-
-func parseDurationPart(value string, unit time.Duration) time.Duration {
-	if len(value) != 0 {
-		if parsed, err := strconv.ParseFloat(value[:len(value)-1], 64); err == nil {
-			return time.Duration(float64(unit) * parsed)
-		}
-	}
-	return 0
-}
-
-// Parse expiration time
-func ParseExpiry(str string) *int64 {
-	// Allow empty string for "never"
+// splitNonEmpty splits a comma separated list, dropping empty entries so
+// an unset flag yields a nil slice rather than []string{""}.
+func splitNonEmpty(str string) []string {
 	if str == "" {
-		never := int64(-1)
-		return &never
-	}
-
-	// Try to parse as ISO8601 duration
-	matches := durationRegex.FindStringSubmatch(str)
-	if matches != nil {
-		years := parseDurationPart(matches[1], time.Hour*24*365)
-		months := parseDurationPart(matches[2], time.Hour*24*30)
-		days := parseDurationPart(matches[3], time.Hour*24)
-		hours := parseDurationPart(matches[4], time.Hour)
-		minutes := parseDurationPart(matches[5], time.Second*60)
-		seconds := parseDurationPart(matches[6], time.Second)
-		d := time.Duration(years + months + days + hours + minutes + seconds)
-		if d == 0 {
-			return nil
-		}
-
-		expiry := time.Now().Add(d).Unix()
-		return &expiry
-	}
-
-	// Try to parse as absolute time
-	t, err := time.Parse(time.RFC3339, str)
-	if err != nil {
 		return nil
 	}
-	expiry := t.Unix()
-	return &expiry
-}
-
-func PublishHandler(store *Store) handleFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		err := r.ParseForm()
-		if err != nil {
-			log.Println("Failed to parse publish data:", err)
-			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		app := r.PostForm.Get("app")
-		name := r.PostForm.Get("name")
-		auth := r.PostForm.Get("auth")
-
-		log.Printf("Request to publish %v/%v auth: '%v'\n", app, name, auth)
-
-		id, err := store.Auth(app, name, auth)
-		if err != nil {
-			var e *authError
-			if errors.As(err, &e) {
-				switch e.Reason() {
-				case "unauthorized":
-					log.Printf("Authentication for %v/%v failed. %v\n", app, name, e)
-					http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
-					return
-				case "busy":
-					log.Printf("Authentication for stream %v on %v/%v succeeded. %v\n", id, app, name, e)
-					http.Error(w, "409 Conflict", http.StatusConflict)
-					return
-				case "blocked":
-					log.Printf("Authentication for stream %v on %v/%v succeeded. %v\n", id, app, name, e)
-					http.Error(w, "403 Forbidden", http.StatusForbidden)
-					return
-				}
-			}
-		}
-
-		if err = store.SetActive(id); err != nil {
-			log.Println(err)
-			return
-		}
-
-		log.Printf("Authentication for stream %v on %v/%v succeeded. Publish ok.\n", id, app, name)
-	}
+	return strings.Split(str, ",")
 }
 
-func UnpublishHandler(store *Store) handleFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseForm(); err != nil {
-			log.Println("Failed to parse unpublish data:", err)
-			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		app := r.PostForm.Get("app")
-		name := r.PostForm.Get("name")
-
-		if err := store.SetInactive(app, name); err != nil {
-			fmt.Println("Unpublish failed:", err)
-			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+// csrfExemptBearer wraps next with protect (gorilla/csrf's Protect
+// middleware), except for requests carrying a Bearer token that
+// store.ValidApiToken accepts, which would otherwise be rejected for
+// lacking a CSRF cookie/token pair.
+func csrfExemptBearer(protect func(http.Handler) http.Handler, store *Store, next http.Handler) http.Handler {
+	protected := protect(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token := strings.TrimPrefix(auth, "Bearer "); token != auth && store.ValidApiToken(token) {
+			next.ServeHTTP(w, r)
 			return
 		}
-
-		log.Printf("Unpublish %v/%v ok\n", app, name)
-	}
-}
-
-func FormHandler(store *Store) handleFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		data := TemplateData{
-			Store:        store.Get(),
-			CsrfTemplate: csrf.TemplateField(r),
-		}
-
-		if err := templates.ExecuteTemplate(w, "form.html", data); err != nil {
-			log.Println("FormHandler: Template failed", err)
-		}
-	}
-}
-
-func AddHandler(store *Store) handleFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var errs []error
-
-		expiry := ParseExpiry(r.PostFormValue("auth_expire"))
-		if expiry == nil {
-			errs = append(errs, fmt.Errorf("Invalid auth expiry: '%v'", r.PostFormValue("auth_expire")))
-		}
-
-		name := r.PostFormValue("name")
-		if len(name) == 0 {
-			errs = append(errs, fmt.Errorf("Stream name must be set"))
-		} else if name != url.PathEscape(name) {
-			errs = append(errs, fmt.Errorf("Stream name contains unsafe characters"))
-		}
-
-		// used by dumpscript, not user visible
-		blocked, err := strconv.ParseBool(r.PostFormValue("blocked"));
-		if err != nil {
-			blocked = false
-		}
-
-		// TODO: more validation
-		if len(errs) == 0 {
-			stream := &storage.Stream{
-				Name:        name,
-				Application: r.PostFormValue("application"),
-				AuthKey:     r.PostFormValue("auth_key"),
-				AuthExpire:  *expiry,
-				Notes:       r.PostFormValue("notes"),
-				Blocked:     blocked,
-			}
-
-			if err := store.AddStream(stream); err != nil {
-				errs = append(errs, fmt.Errorf("Failed to add stream."))
-				log.Printf("AddHandler: Failed to add stream. %v", err)
-			} else {
-				log.Println("New stream added:", stream)
-				// log.Println("Store add", stream, store.State)
-			}
-		}
-
-		if len(errs) > 0 {
-			data := TemplateData{
-				Store:        store.Get(),
-				CsrfTemplate: csrf.TemplateField(r),
-				Errors:       errs,
-			}
-			if err := templates.ExecuteTemplate(w, "form.html", data); err != nil {
-				log.Println("AddHandler: Template failed", err)
-			}
-		} else {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-		}
-	}
+		protected.ServeHTTP(w, r)
+	})
 }
 
-func RemoveHandler(store *Store) handleFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var errs []error
-		id := r.PostFormValue("id")
-
-		stream, err := store.GetStreamById(id)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("Couldn't remove stream"))
-			log.Printf("RemoveHandler: Stream id not found. %v", err)
-		} else {
-			app := stream.Application
-			name := stream.Name
-
-			if stream.Active {
-				DropStreamPublisher(store, id)
-			}
-
-			if err := store.RemoveStream(id); err != nil {
-				errs = append(errs, fmt.Errorf("Failed to remove stream."))
-				log.Printf("RemoveHandler: Failed to remove stream %v (%v/%v). %v", id, app, name, err)
-			} else {
-				// TODO: var stream is dangling at this point
-				// check what to do... stream = nil?
-				log.Printf("Removed stream %v (%v/%v)", id, app, name)
-			}
-		}
-
-		if len(errs) > 0 {
-			data := TemplateData{
-				Store:        store.Get(),
-				CsrfTemplate: csrf.TemplateField(r),
-				Errors:       errs,
-			}
-
-			if err := templates.ExecuteTemplate(w, "form.html", data); err != nil {
-				log.Println("RemoveHandler: Template failed", err)
-			}
-		} else {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-		}
-	}
-}
-
-func BlockHandler(store *Store) handleFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var errs []error
-		id := r.PostFormValue("id")
-
-		app, name, err := store.GetAppNameById(id)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("Couldn't change stream block status."))
-			log.Printf("BlockHandler: %v", err)
-		} else {
-			state, _ := strconv.ParseBool(r.PostFormValue("blocked"))
-			newstate, action := func(bool) (bool, string) {
-				if state == true { return false, "unblock"} else {return true, "block"}
-			}(state)
-
-			if err := store.SetBlocked(id, newstate); err != nil {
-				errs = append(errs, fmt.Errorf("Failed to %v stream.", action))
-				log.Printf("BlockHandler: Failed to %v stream %v (%v/%v). %v", action, id, app, name, err)
-			} else {
-				if newstate == true {
-					DropStreamPublisher(store, id)
-				}
-				log.Printf("Stream %v (%v/%v) %ved", id, app, name, action)
-			}
-		}
-
-		if len(errs) > 0 {
-			data := TemplateData{
-				Store:        store.Get(),
-				CsrfTemplate: csrf.TemplateField(r),
-				Errors:       errs,
-			}
-			if err := templates.ExecuteTemplate(w, "form.html", data); err != nil {
-				log.Println("BlockHandler: Template failed", err)
-			}
-		} else {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-		}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		runHashPasswordCommand(os.Args[2:])
+		return
 	}
-}
 
-func main() {
-	var path = flag.String("store", "store.db", "Path to store file")
+	var storageDSN = flag.String("storage", "file://store.db",
+		"Storage backend, either file://path (protobuf on disk) or sqlite://path")
 	var apps = flag.String("app", "stream", "Comma separated list of RTMP applications")
 	var apiAddr = flag.String("apiAddr", "localhost:8080", "API bind address")
 	var frontendAddr = flag.String("frontendAddr", "localhost:8082", "Frontend bind address")
@@ -300,9 +59,38 @@ func main() {
 	var prefix = flag.String("subpath", "", "Set to allow running behind reverse-proxy at that subpath")
 	var ctrlurl = flag.String("ctrlurl", "",
 		"Set nginx-rtmp control url to allow dropping currently published streams (needs additional configuration for the nginx-rtmp module)")
+	var apiTokens = flag.String("apiToken", "",
+		"Comma separated list of bearer tokens allowed to call the /api/v1 JSON API, empty leaves it unreachable")
+	var oidcIssuer = flag.String("oidcIssuer", "", "OIDC issuer URL, set to enable admin login")
+	var oidcClientID = flag.String("oidcClientID", "", "OIDC client id")
+	var oidcClientSecret = flag.String("oidcClientSecret", "", "OIDC client secret")
+	var oidcRedirectURL = flag.String("oidcRedirectURL", "", "OIDC callback URL, usually <frontend url>/callback")
+	var oidcGroups = flag.String("oidcGroups", "", "Comma separated list of OIDC groups allowed to log in, empty allows any authenticated user")
+	var oidcEmails = flag.String("oidcEmails", "", "Comma separated list of OIDC email addresses allowed to log in, empty allows any authenticated user")
+	var htpasswdPath = flag.String("htpasswd", "", "Path to an htpasswd-style file gating the admin frontend with Basic Auth, set to enable")
+	var logFormat = flag.String("logFormat", "text", "Stream event log format, either text or json")
+	var logFile = flag.String("logFile", "", "Path to write stream event logs to, empty logs to stderr")
+	var logMaxSizeMB = flag.Int("logMaxSizeMB", 100, "Max size in megabytes of a log file before it gets rotated")
+	var logMaxBackups = flag.Int("logMaxBackups", 3, "Max number of rotated log files to retain")
+	var logMaxAgeDays = flag.Int("logMaxAgeDays", 28, "Max age in days to retain rotated log files")
+	var webhookURLs = flag.String("webhookURL", "", "Comma separated list of URLs to POST stream lifecycle events to, set to enable")
+	var webhookSecret = flag.String("webhookSecret", "", "Secret used to HMAC-SHA256 sign webhook payloads")
+	var shutdownTimeout = flag.Duration("shutdownTimeout", 15*time.Second, "Time to wait for in-flight requests to drain on SIGTERM/SIGINT before exiting")
 	flag.Parse()
 
-	store, err := NewStore(*path, strings.Split(*apps, ","), *prefix)
+	if urls := splitNonEmpty(*webhookURLs); len(urls) > 0 {
+		webhooks = NewWebhookDispatcher(urls, *webhookSecret, 4)
+	}
+
+	InitLogger(LogConfig{
+		Format:     *logFormat,
+		File:       *logFile,
+		MaxSizeMB:  *logMaxSizeMB,
+		MaxBackups: *logMaxBackups,
+		MaxAgeDays: *logMaxAgeDays,
+	})
+
+	store, err := NewStore(*storageDSN, strings.Split(*apps, ","), *prefix)
 	if err != nil {
 		log.Fatal("noo", err)
 	}
@@ -319,17 +107,70 @@ func main() {
 		log.Println(err)
 	}
 
+	if err := store.SetApiTokens(splitNonEmpty(*apiTokens)); err != nil {
+		log.Println(err)
+	}
+
 	api := mux.NewRouter()
 	api.Path("/publish").Methods("POST").HandlerFunc(PublishHandler(store))
 	api.Path("/unpublish").Methods("POST").HandlerFunc(UnpublishHandler(store))
+	api.Path("/refresh").Methods("POST").HandlerFunc(RefreshHandler(store))
+	RegisterApiV1(api, store)
+	RegisterMetrics(api, store)
 
 	frontend := mux.NewRouter()
 	sub := frontend.PathPrefix(*prefix).Subrouter()
-	sub.Path("/").Methods("GET").HandlerFunc(FormHandler(store))
-	sub.Path("/add").Methods("POST").HandlerFunc(AddHandler(store))
-	sub.Path("/remove").Methods("POST").HandlerFunc(RemoveHandler(store))
-	sub.Path("/block").Methods("POST").HandlerFunc(BlockHandler(store))
-	sub.Path("/dumpscript").Methods("GET").HandlerFunc(DumpscriptHandler(store))
+
+	var oidcAuth *OIDCAuth
+	if *oidcIssuer != "" {
+		oidcAuth, err = NewOIDCAuth(context.Background(), OIDCConfig{
+			IssuerURL:     *oidcIssuer,
+			ClientID:      *oidcClientID,
+			ClientSecret:  *oidcClientSecret,
+			RedirectURL:   *oidcRedirectURL,
+			AllowedGroups: splitNonEmpty(*oidcGroups),
+			AllowedEmails: splitNonEmpty(*oidcEmails),
+		}, store.State.Secret)
+		if err != nil {
+			log.Fatal("Failed to set up OIDC login: ", err)
+		}
+
+		sub.Path("/login").Methods("GET").HandlerFunc(oidcAuth.LoginHandler())
+		sub.Path("/callback").Methods("GET").HandlerFunc(oidcAuth.CallbackHandler())
+	}
+
+	// admin is a child router carrying the same prefix as sub, used so the
+	// RequireAuth middleware (when OIDC is configured) only gates the admin
+	// routes and not /login, /callback or the static assets below.
+	admin := sub.NewRoute().Subrouter()
+	if oidcAuth != nil {
+		admin.Use(oidcAuth.RequireAuth)
+	}
+
+	var htpasswd *htpasswdFile
+	if *htpasswdPath != "" {
+		htpasswd, err = loadHtpasswd(*htpasswdPath)
+		if err != nil {
+			log.Fatal("Failed to load -htpasswd file: ", err)
+		}
+	}
+
+	// view requires at least read-only access; mutate requires full admin.
+	view := admin.NewRoute().Subrouter()
+	mutate := admin.NewRoute().Subrouter()
+	if htpasswd != nil {
+		view.Use(BasicAuthMiddleware(htpasswd, RoleReadOnly))
+		mutate.Use(BasicAuthMiddleware(htpasswd, RoleAdmin))
+	}
+
+	view.Path("/").Methods("GET").HandlerFunc(FormHandler(store))
+	view.Path("/dumpscript").Methods("GET").HandlerFunc(DumpscriptHandler(store))
+	view.Path("/export").Methods("GET").HandlerFunc(ExportHandler(store))
+	mutate.Path("/add").Methods("POST").HandlerFunc(AddHandler(store))
+	mutate.Path("/remove").Methods("POST").HandlerFunc(RemoveHandler(store))
+	mutate.Path("/block").Methods("POST").HandlerFunc(BlockHandler(store))
+	mutate.Path("/import").Methods("POST").HandlerFunc(ImportHandler(store))
+	RegisterApiV1(sub, store)
 	sub.PathPrefix("/public/").Handler(
 		http.StripPrefix(*prefix+"/public/", http.FileServer(statikFS)))
 
@@ -341,7 +182,7 @@ func main() {
 	}
 
 	frontendServer := &http.Server{
-		Handler:      CSRF(frontend),
+		Handler:      csrfExemptBearer(CSRF, store, frontend),
 		Addr:         *frontendAddr,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
@@ -357,38 +198,56 @@ func main() {
 				return
 			case <-ticker.C:
 				store.Expire()
+				store.ExpireLeases()
+				UpdateStreamMetrics(store)
 			}
 		}
 	}()
 
 	// Run http servers
+	var servers sync.WaitGroup
+	servers.Add(2)
 	go func() {
+		defer servers.Done()
 		log.Println("API Listening on", apiServer.Addr)
-		if err := apiServer.ListenAndServe(); err != nil {
+		if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Println(err)
 		}
 	}()
 	go func() {
+		defer servers.Done()
 		log.Println("Frontend Listening on", frontendServer.Addr)
-		if err := frontendServer.ListenAndServe(); err != nil {
+		if err := frontendServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Println(err)
 		}
 	}()
 
 	// Handle signals
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	log.Println("Shutting down")
+	close(stopPolling)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
 	defer cancel()
 
-	// Shut everything down
-	close(stopPolling)
-	go apiServer.Shutdown(ctx)
-	go frontendServer.Shutdown(ctx)
+	// Drop any still-active publishers so nginx-rtmp cleanly tears down
+	// their sessions before we stop answering control requests.
+	for _, stream := range store.Get().State.Streams {
+		if stream.Active {
+			if err := ReqDropStreamPublisher(store, stream.Id); err != nil {
+				log.Println(err)
+			}
+		}
+	}
 
-	// Wait until timeout
-	log.Println("Shutting down")
-	<-ctx.Done()
+	apiServer.Shutdown(ctx)
+	frontendServer.Shutdown(ctx)
+	servers.Wait()
+
+	if err := store.Close(); err != nil {
+		log.Println("Failed to close store:", err)
+	}
 }
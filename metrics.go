@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	streamsTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rtmp_auth_streams_total",
+		Help: "Number of configured streams by state.",
+	}, []string{"state"})
+
+	publishRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtmp_auth_publish_total",
+		Help: "Number of publish requests handled by result.",
+	}, []string{"result"})
+
+	unpublishRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rtmp_auth_unpublish_total",
+		Help: "Number of unpublish requests handled.",
+	})
+
+	nginxControlRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rtmp_auth_nginx_control_requests_total",
+		Help: "Number of nginx-rtmp control requests by result.",
+	}, []string{"result"})
+
+	streamActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rtmp_auth_stream_active",
+		Help: "Whether a stream currently has an active publisher (1) or not (0).",
+	}, []string{"app", "name"})
+
+	nginxControlDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "rtmp_auth_nginx_control_request_duration_seconds",
+		Help: "Latency of nginx-rtmp control requests.",
+	})
+
+	streamsConfigured = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rtmp_auth_streams_configured",
+		Help: "Number of streams configured in the store.",
+	})
+
+	streamsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rtmp_auth_streams_active",
+		Help: "Number of streams currently publishing.",
+	})
+
+	streamsBlocked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rtmp_auth_streams_blocked",
+		Help: "Number of streams currently blocked.",
+	})
+
+	streamExpirySeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rtmp_auth_stream_expiry_seconds",
+		Help: "Seconds until a stream's auth key expires, negative if already expired. Absent for streams that never expire.",
+	}, []string{"app", "name"})
+
+	publishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "rtmp_auth_publish_duration_seconds",
+		Help: "Latency of the store.Auth check performed on publish.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(streamsTotal, publishRequestsTotal, unpublishRequestsTotal,
+		nginxControlRequestsTotal, streamActive, nginxControlDuration,
+		streamsConfigured, streamsActive, streamsBlocked,
+		streamExpirySeconds, publishDuration)
+}
+
+// UpdateStreamMetrics recomputes the streams_total and stream_active
+// gauges from the current store state. Called from the same ticker
+// goroutine that runs Expire().
+func UpdateStreamMetrics(store *Store) {
+	s := store.Get()
+
+	var active, blocked, expired int
+	now := time.Now().Unix()
+	for _, stream := range s.State.Streams {
+		if stream.AuthExpire != -1 && stream.AuthExpire < now {
+			expired++
+		}
+		if stream.Blocked {
+			blocked++
+		}
+		if stream.Active {
+			active++
+		}
+		streamActive.WithLabelValues(stream.Application, stream.Name).Set(boolToFloat(stream.Active))
+		if stream.AuthExpire != -1 {
+			streamExpirySeconds.WithLabelValues(stream.Application, stream.Name).Set(float64(stream.AuthExpire - now))
+		}
+	}
+	streamsTotal.WithLabelValues("active").Set(float64(active))
+	streamsTotal.WithLabelValues("blocked").Set(float64(blocked))
+	streamsTotal.WithLabelValues("expired").Set(float64(expired))
+
+	streamsConfigured.Set(float64(len(s.State.Streams)))
+	streamsActive.Set(float64(active))
+	streamsBlocked.Set(float64(blocked))
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// HealthzHandler reports healthy only if a read lock on the store and, for
+// backends implementing healthProber, a trivial backend round-trip both
+// succeed. Other backends (fileBackend) get no round-trip.
+func HealthzHandler(store *Store) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store.RLock()
+		backend := store.backend
+		store.RUnlock()
+
+		if prober, ok := backend.(healthProber); ok {
+			if err := prober.Ping(); err != nil {
+				http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}
+}
+
+// healthProber is implemented by backends that can perform a trivial
+// round-trip (e.g. a throwaway insert+delete) to prove they're reachable.
+type healthProber interface {
+	Ping() error
+}
+
+// RegisterMetrics mounts /metrics and /healthz on router.
+func RegisterMetrics(router *mux.Router, store *Store) {
+	router.Path("/metrics").Methods("GET").Handler(promhttp.Handler())
+	router.Path("/healthz").Methods("GET").HandlerFunc(HealthzHandler(store))
+}
@@ -3,85 +3,178 @@ package main
 import (
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type nginxControlError struct {
-	Msg string
-	RequestSent bool
+	Msg              string
+	RequestSent      bool
 	GotValidResponse bool
-	Returncode int
-	Err error
+	Returncode       int
+	Err              error
+	CircuitOpen      bool
 }
 
 func (e *nginxControlError) Error() string {
+	if e.CircuitOpen {
+		return fmt.Sprintf("%v Circuit breaker open.", e.Msg)
+	}
 	if e.GotValidResponse {
 		return fmt.Sprintf("%v Status: %v %v", e.Msg, e.Returncode, http.StatusText(e.Returncode))
 	}
 	return fmt.Sprintf("%v %v", e.Msg, e.Err)
 }
 
+// nginxControl wraps the HTTP calls to the nginx-rtmp control module with a
+// timeout, exponential backoff with jitter on 5xx/connection errors, and a
+// circuit breaker so a flapping or dead nginx doesn't stall Expire() or
+// RemoveHandler behind a pile of slow, doomed requests.
+type nginxControl struct {
+	client           *http.Client
+	maxAttempts      int
+	baseDelay        time.Duration
+	failureThreshold int
+	cooldown         time.Duration
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	openUntil           time.Time
+}
+
+// newNginxControl returns a control client with sane defaults: a 5 second
+// per-request timeout, up to 4 attempts with exponential backoff, and a
+// circuit that opens for 30s after 5 consecutive failures.
+func newNginxControl() *nginxControl {
+	return &nginxControl{
+		client:           &http.Client{Timeout: 5 * time.Second},
+		maxAttempts:      4,
+		baseDelay:        200 * time.Millisecond,
+		failureThreshold: 5,
+		cooldown:         30 * time.Second,
+	}
+}
+
+// defaultNginxControl is shared by all control requests; nginx-rtmp is a
+// single endpoint per process so one breaker is enough.
+var defaultNginxControl = newNginxControl()
+
+// Healthy reports whether the circuit breaker currently allows requests
+// through.
+func (c *nginxControl) Healthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().After(c.openUntil)
+}
+
+func (c *nginxControl) recordSuccess() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.consecutiveFailures = 0
+	c.openUntil = time.Time{}
+}
+
+func (c *nginxControl) recordFailure() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.consecutiveFailures++
+	if c.consecutiveFailures >= c.failureThreshold {
+		c.openUntil = time.Now().Add(c.cooldown)
+	}
+}
+
+// do performs a GET against url, retrying on 5xx responses and connection
+// errors with exponential backoff and jitter, up to maxAttempts. It returns
+// the last good *http.Response or a *nginxControlError.
+func (c *nginxControl) do(url string) (*http.Response, error) {
+	if !c.Healthy() {
+		return nil, &nginxControlError{Msg: "nginx-rtmp control request skipped.", CircuitOpen: true}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < c.maxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := c.baseDelay * time.Duration(1<<uint(attempt-1))
+			delay += time.Duration(rand.Int63n(int64(delay) + 1))
+			time.Sleep(delay)
+		}
+
+		start := time.Now()
+		resp, err := c.client.Get(url)
+		nginxControlDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			lastErr = &nginxControlError{Msg: "nginx-rtmp control request failed.", RequestSent: true, Err: err}
+			c.recordFailure()
+			nginxControlRequestsTotal.WithLabelValues("error").Inc()
+			continue
+		}
+
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			lastErr = &nginxControlError{
+				Msg: "nginx-rtmp control request failed.", RequestSent: true,
+				GotValidResponse: true, Returncode: resp.StatusCode,
+			}
+			c.recordFailure()
+			nginxControlRequestsTotal.WithLabelValues("error").Inc()
+			continue
+		}
+
+		c.recordSuccess()
+		nginxControlRequestsTotal.WithLabelValues("ok").Inc()
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
 func ReqDropStreamPublisher(store *Store, id string) error {
 	ctrlurl := store.State.CtrlUrl
 	if len(ctrlurl) == 0 {
-		return &nginxControlError{
-			"ReqDropStreamPublisher: Didn't request to drop stream publisher. Control URL not set.",
-			false, false, -1, nil,
-		}
+		return &nginxControlError{Msg: "ReqDropStreamPublisher: Didn't request to drop stream publisher. Control URL not set."}
 	}
 
 	// Get streams application and name
 	stream, err := store.GetStreamById(id)
 	if err != nil {
-		return &nginxControlError{
-			fmt.Sprintf("ReqDropStreamPublisher: Stream id %v not found.", id),
-			false, false, -1, nil,
-		}
+		return &nginxControlError{Msg: fmt.Sprintf("ReqDropStreamPublisher: Stream id %v not found.", id)}
 	}
 	app := stream.Application
 	name := stream.Name
 
 	// Check if stream is published
 	if stream.Active == false {
-		return &nginxControlError{
-			fmt.Sprintf("ReqDropStreamPublisher: Didn't request to drop stream publisher. Stream id %v not active.", id),
-			false, false, -1, nil,
-		}
+		return &nginxControlError{Msg: fmt.Sprintf("ReqDropStreamPublisher: Didn't request to drop stream publisher. Stream id %v not active.", id)}
 	}
 
 	// Check if another stream is published on app/name
 	for _, stream := range store.State.Streams {
 		if stream.Application == app && stream.Name == name && stream.Active == true && stream.Id != id {
-			return &nginxControlError{
-				fmt.Sprintf(
-					"ReqDropStreamPublisher: Not dropping publisher. Publish for another stream id on %v/%v was granted.",
-					app, name,
-				),
-				false, false, -1, nil,
-			}
+			return &nginxControlError{Msg: fmt.Sprintf(
+				"ReqDropStreamPublisher: Not dropping publisher. Publish for another stream id on %v/%v was granted.",
+				app, name,
+			)}
 		}
 	}
 
 	// Drop current publisher on app/name
-	resp, err := http.Get(fmt.Sprintf("%v/control/drop/publisher?app=%v&name=%v", ctrlurl, app, name))
+	resp, err := defaultNginxControl.do(fmt.Sprintf("%v/control/drop/publisher?app=%v&name=%v", ctrlurl, app, name))
 	if err != nil {
-		// log.Printf("ReqDropStreamPublisher req response: %T, %v", resp, resp)
-		return &nginxControlError{"ReqDropStreamPublisher: nginx-rtmp control request failed.", true, false, 0, err}
+		return err
 	}
+	defer resp.Body.Close()
 
-	if resp != nil {
-		defer resp.Body.Close()
-		if resp.StatusCode == http.StatusOK {
-			err := store.SetInactive(app, name)
-			if err != nil {
-				log.Println(err)
-			}
-			return nil
-		} else {
-			return &nginxControlError{fmt.Sprintf("ReqDropStreamPublisher: nginx-rtmp control request denied."), true, true, resp.StatusCode, nil}
+	if resp.StatusCode == http.StatusOK {
+		if err := store.SetInactive(app, name); err != nil {
+			log.Println(err)
 		}
+		return nil
 	}
 
-	// shouldn't happen
-	return &nginxControlError{fmt.Sprintf("ReqDropStreamPublisher: nginx-rtmp control request failed."), true, false, -1, nil}
+	return &nginxControlError{
+		Msg: "ReqDropStreamPublisher: nginx-rtmp control request denied.",
+		RequestSent: true, GotValidResponse: true, Returncode: resp.StatusCode,
+	}
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	c := &nginxControl{failureThreshold: 3, cooldown: 50 * time.Millisecond}
+
+	for i := 0; i < 2; i++ {
+		c.recordFailure()
+		if !c.Healthy() {
+			t.Fatalf("circuit opened after only %d failure(s), want threshold 3", i+1)
+		}
+	}
+
+	c.recordFailure()
+	if c.Healthy() {
+		t.Fatal("expected circuit to open once failureThreshold consecutive failures are recorded")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !c.Healthy() {
+		t.Fatal("expected circuit to close again once cooldown has elapsed")
+	}
+}
+
+func TestCircuitBreakerResetsOnSuccess(t *testing.T) {
+	c := &nginxControl{failureThreshold: 2, cooldown: time.Second}
+
+	c.recordFailure()
+	c.recordSuccess()
+	c.recordFailure()
+
+	if !c.Healthy() {
+		t.Fatal("a success should reset the failure streak, so one more failure shouldn't open the circuit")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+const sessionName = "rtmp-auth-session"
+
+// OIDCConfig holds the configuration needed to authenticate admin users
+// against an external OpenID Connect provider (e.g. dex).
+type OIDCConfig struct {
+	IssuerURL     string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	AllowedGroups []string
+	AllowedEmails []string
+}
+
+func (cfg OIDCConfig) enabled() bool {
+	return cfg.IssuerURL != ""
+}
+
+// OIDCAuth wraps the OIDC provider, OAuth2 config and signed session store
+// used to gate the admin frontend behind a login.
+type OIDCAuth struct {
+	cfg      OIDCConfig
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	oauth    oauth2.Config
+	sessions sessions.Store
+}
+
+// oidcClaims is the subset of the ID token we care about for access control.
+type oidcClaims struct {
+	Email  string   `json:"email"`
+	Groups []string `json:"groups"`
+}
+
+// NewOIDCAuth discovers the provider's endpoints and JWKS via its issuer URL
+// and prepares an authenticator gating access on cfg.AllowedGroups /
+// cfg.AllowedEmails. The session cookie is signed with secret, reusing
+// store.State.Secret like the existing CSRF protection.
+func NewOIDCAuth(ctx context.Context, cfg OIDCConfig, secret []byte) (*OIDCAuth, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCAuth{
+		cfg:      cfg,
+		provider: provider,
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+		},
+		sessions: sessions.NewCookieStore(secret),
+	}, nil
+}
+
+func randomState() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// LoginHandler redirects the browser to the provider's authorization
+// endpoint, stashing a CSRF-style state value in the session cookie.
+func (a *OIDCAuth) LoginHandler() handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, err := randomState()
+		if err != nil {
+			log.Println("LoginHandler: Failed to generate state", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		session, _ := a.sessions.New(r, sessionName)
+		session.Values["state"] = state
+		if err := session.Save(r, w); err != nil {
+			log.Println("LoginHandler: Failed to save state", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, a.oauth.AuthCodeURL(state), http.StatusFound)
+	}
+}
+
+// CallbackHandler exchanges the authorization code for tokens, verifies the
+// ID token's signature, exp, iss and aud, and stores the verified claims in
+// a signed session cookie.
+func (a *OIDCAuth) CallbackHandler() handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := a.sessions.Get(r, sessionName)
+		if err != nil || session.Values["state"] != r.URL.Query().Get("state") {
+			log.Println("CallbackHandler: State mismatch")
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		token, err := a.oauth.Exchange(r.Context(), r.URL.Query().Get("code"))
+		if err != nil {
+			log.Println("CallbackHandler: Code exchange failed", err)
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			log.Println("CallbackHandler: No id_token in response")
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		idToken, err := a.verifier.Verify(r.Context(), rawIDToken)
+		if err != nil {
+			log.Println("CallbackHandler: Failed to verify id_token", err)
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var claims oidcClaims
+		if err := idToken.Claims(&claims); err != nil {
+			log.Println("CallbackHandler: Failed to parse claims", err)
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !a.authorized(claims) {
+			log.Printf("CallbackHandler: %v is not in an allowed group\n", claims.Email)
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+
+		delete(session.Values, "state")
+		session.Values["email"] = claims.Email
+		session.Values["groups"] = strings.Join(claims.Groups, ",")
+		if err := session.Save(r, w); err != nil {
+			log.Println("CallbackHandler: Failed to save session", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+func (a *OIDCAuth) authorized(claims oidcClaims) bool {
+	if len(a.cfg.AllowedGroups) == 0 && len(a.cfg.AllowedEmails) == 0 {
+		return true
+	}
+	for _, email := range a.cfg.AllowedEmails {
+		if email == claims.Email {
+			return true
+		}
+	}
+	for _, allowed := range a.cfg.AllowedGroups {
+		for _, group := range claims.Groups {
+			if allowed == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequireAuth gates access to next behind a valid session created by
+// CallbackHandler, redirecting to /login otherwise.
+func (a *OIDCAuth) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := a.sessions.Get(r, sessionName)
+		if err != nil || session.Values["email"] == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
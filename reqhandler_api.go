@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"errors"
 	"net/http"
+	"time"
 )
 
 func PublishHandler(store *Store) handleFunc {
@@ -22,21 +24,32 @@ func PublishHandler(store *Store) handleFunc {
 
 		log.Printf("Request to publish %v/%v auth: '%v'\n", app, name, auth)
 
+		authStart := time.Now()
 		id, err := store.Auth(app, name, auth)
+		publishDuration.Observe(time.Since(authStart).Seconds())
 		if err != nil {
 			var e *authError
 			if errors.As(err, &e) {
-				switch e.Reason() {
+				switch e.getReason() {
 				case "unauthorized":
 					log.Printf("Authentication for %v/%v failed. %v\n", app, name, e)
+					publishRequestsTotal.WithLabelValues("unauthorized").Inc()
+					logEvent("publish_denied", app, name, id, r, e.getReason())
+					dispatchWebhook("publish_denied", app, name, id, e.getReason())
 					http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
 					return
 				case "busy":
 					log.Printf("Authentication for stream %v on %v/%v succeeded. %v\n", id, app, name, e)
+					publishRequestsTotal.WithLabelValues("busy").Inc()
+					logEvent("publish_denied", app, name, id, r, e.getReason())
+					dispatchWebhook("publish_denied", app, name, id, e.getReason())
 					http.Error(w, "409 Conflict", http.StatusConflict)
 					return
 				case "blocked":
 					log.Printf("Authentication for stream %v on %v/%v succeeded. %v\n", id, app, name, e)
+					publishRequestsTotal.WithLabelValues("blocked").Inc()
+					logEvent("publish_denied", app, name, id, r, e.getReason())
+					dispatchWebhook("publish_denied", app, name, id, e.getReason())
 					http.Error(w, "403 Forbidden", http.StatusForbidden)
 					return
 				}
@@ -47,8 +60,22 @@ func PublishHandler(store *Store) handleFunc {
 			log.Println(err)
 			return
 		}
+		publishRequestsTotal.WithLabelValues("ok").Inc()
+		logEvent("publish_ok", app, name, id, r, "")
+		dispatchWebhook("publish_ok", app, name, id, "")
+
+		token, err := store.GrantLease(id)
+		if err != nil {
+			log.Println("Failed to grant lease:", err)
+		}
 
 		log.Printf("Authentication for stream %v on %v/%v succeeded. Publish ok.\n", id, app, name)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			LeaseId      string `json:"lease_id"`
+			RefreshToken string `json:"refresh_token"`
+		}{LeaseId: id, RefreshToken: token})
 	}
 }
 
@@ -69,6 +96,11 @@ func UnpublishHandler(store *Store) handleFunc {
 			return
 		}
 
+		store.RevokeLeaseByAppName(app, name)
+		unpublishRequestsTotal.Inc()
+		logEvent("unpublish", app, name, "", r, "")
+		dispatchWebhook("unpublish", app, name, "", "")
+
 		log.Printf("Unpublish %v/%v ok\n", app, name)
 	}
 }
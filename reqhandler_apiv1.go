@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/voc/rtmp-auth/storage"
+)
+
+// apiStream is the JSON representation of a storage.Stream returned by the
+// /api/v1/streams endpoints.
+type apiStream struct {
+	Id          string `json:"id"`
+	Application string `json:"application"`
+	Name        string `json:"name"`
+	AuthKey     string `json:"auth_key"`
+	AuthExpire  string `json:"auth_expire"`
+	Notes       string `json:"notes"`
+	Blocked     bool   `json:"blocked"`
+	Active      bool   `json:"active"`
+}
+
+// apiError is the JSON error envelope returned by the /api/v1/streams endpoints.
+type apiError struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+func formatAuthExpire(expire int64) string {
+	if expire == -1 {
+		return "never"
+	}
+	return time.Unix(expire, 0).UTC().Format(time.RFC3339)
+}
+
+func parseAuthExpire(str string) *int64 {
+	if str == "" || str == "never" {
+		never := int64(-1)
+		return &never
+	}
+	return ParseExpiry(str)
+}
+
+func toApiStream(stream *storage.Stream) apiStream {
+	return apiStream{
+		Id:          stream.Id,
+		Application: stream.Application,
+		Name:        stream.Name,
+		AuthKey:     stream.AuthKey,
+		AuthExpire:  formatAuthExpire(stream.AuthExpire),
+		Notes:       stream.Notes,
+		Blocked:     stream.Blocked,
+		Active:      stream.Active,
+	}
+}
+
+func writeApiError(w http.ResponseWriter, status int, message, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Error: message, Reason: reason})
+}
+
+func writeApiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("apiv1: failed to encode response", err)
+	}
+}
+
+// RequireApiToken validates the Authorization: Bearer <token> header of a
+// request against store.State.ApiTokens, rejecting the request with a 401
+// if it is missing or unknown.
+func RequireApiToken(store *Store) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			token := strings.TrimPrefix(auth, "Bearer ")
+			if token == "" || token == auth || !store.ValidApiToken(token) {
+				writeApiError(w, http.StatusUnauthorized, "unauthorized", "unauthorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type apiStreamRequest struct {
+	Application string `json:"application"`
+	Name        string `json:"name"`
+	AuthKey     string `json:"auth_key"`
+	AuthExpire  string `json:"auth_expire"`
+	Notes       string `json:"notes"`
+	Blocked     bool   `json:"blocked"`
+}
+
+// ApiV1ListStreams handles GET /api/v1/streams
+func ApiV1ListStreams(store *Store) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := store.Get()
+		streams := make([]apiStream, 0, len(s.State.Streams))
+		for _, stream := range s.State.Streams {
+			streams = append(streams, toApiStream(stream))
+		}
+		writeApiJSON(w, http.StatusOK, streams)
+	}
+}
+
+// ApiV1CreateStream handles POST /api/v1/streams
+func ApiV1CreateStream(store *Store) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req apiStreamRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeApiError(w, http.StatusBadRequest, "Malformed JSON body", "invalid_request")
+			return
+		}
+
+		expiry := parseAuthExpire(req.AuthExpire)
+		if expiry == nil {
+			writeApiError(w, http.StatusBadRequest, "Invalid auth_expire", "invalid_request")
+			return
+		}
+		if req.Name == "" {
+			writeApiError(w, http.StatusBadRequest, "Stream name must be set", "invalid_request")
+			return
+		}
+
+		stream := &storage.Stream{
+			Name:        req.Name,
+			Application: req.Application,
+			AuthKey:     req.AuthKey,
+			AuthExpire:  *expiry,
+			Notes:       req.Notes,
+			Blocked:     req.Blocked,
+		}
+
+		if err := store.AddStream(stream); err != nil {
+			log.Printf("ApiV1CreateStream: Failed to add stream. %v", err)
+			writeApiError(w, http.StatusInternalServerError, "Failed to add stream", "")
+			return
+		}
+
+		log.Println("New stream added via api/v1:", stream)
+		writeApiJSON(w, http.StatusCreated, toApiStream(stream))
+	}
+}
+
+// ApiV1GetStream handles GET /api/v1/streams/{id}
+func ApiV1GetStream(store *Store) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		stream, err := store.GetStreamById(id)
+		if err != nil {
+			writeApiError(w, http.StatusNotFound, "Stream not found", "unauthorized")
+			return
+		}
+		writeApiJSON(w, http.StatusOK, toApiStream(stream))
+	}
+}
+
+type apiStreamPatch struct {
+	Notes      *string `json:"notes"`
+	AuthExpire *string `json:"auth_expire"`
+	Blocked    *bool   `json:"blocked"`
+}
+
+// ApiV1PatchStream handles PATCH /api/v1/streams/{id}
+func ApiV1PatchStream(store *Store) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var patch apiStreamPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeApiError(w, http.StatusBadRequest, "Malformed JSON body", "invalid_request")
+			return
+		}
+
+		var expiry *int64
+		if patch.AuthExpire != nil {
+			expiry = parseAuthExpire(*patch.AuthExpire)
+			if expiry == nil {
+				writeApiError(w, http.StatusBadRequest, "Invalid auth_expire", "invalid_request")
+				return
+			}
+		}
+
+		stream, err := store.UpdateStream(id, patch.Notes, expiry, patch.Blocked)
+		if err != nil {
+			writeApiError(w, http.StatusNotFound, "Stream not found", "unauthorized")
+			return
+		}
+
+		if patch.Blocked != nil && *patch.Blocked {
+			var e *nginxControlError
+			if err := ReqDropStreamPublisher(store, id); err != nil && errors.As(err, &e) && e.RequestSent {
+				log.Println(e)
+			}
+		}
+
+		log.Printf("Stream %v updated via api/v1", id)
+		writeApiJSON(w, http.StatusOK, toApiStream(stream))
+	}
+}
+
+// ApiV1DeleteStream handles DELETE /api/v1/streams/{id}
+func ApiV1DeleteStream(store *Store) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		stream, err := store.GetStreamById(id)
+		if err != nil {
+			writeApiError(w, http.StatusNotFound, "Stream not found", "unauthorized")
+			return
+		}
+
+		if stream.Active {
+			var e *nginxControlError
+			if err := ReqDropStreamPublisher(store, id); err != nil && errors.As(err, &e) && e.RequestSent {
+				log.Println(e)
+			}
+		}
+
+		if err := store.RemoveStream(id); err != nil {
+			log.Printf("ApiV1DeleteStream: Failed to remove stream %v. %v", id, err)
+			writeApiError(w, http.StatusInternalServerError, "Failed to remove stream", "")
+			return
+		}
+
+		log.Printf("Removed stream %v via api/v1", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RegisterApiV1 mounts the JSON stream CRUD API on router, gated by
+// RequireApiToken instead of CSRF.
+func RegisterApiV1(router *mux.Router, store *Store) {
+	v1 := router.PathPrefix("/api/v1/streams").Subrouter()
+	v1.Use(RequireApiToken(store))
+	v1.Path("").Methods("GET").HandlerFunc(ApiV1ListStreams(store))
+	v1.Path("").Methods("POST").HandlerFunc(ApiV1CreateStream(store))
+	v1.Path("/{id}").Methods("GET").HandlerFunc(ApiV1GetStream(store))
+	v1.Path("/{id}").Methods("PATCH").HandlerFunc(ApiV1PatchStream(store))
+	v1.Path("/{id}").Methods("DELETE").HandlerFunc(ApiV1DeleteStream(store))
+}
@@ -10,6 +10,11 @@ import (
 	"net/url"
 )
 
+// DumpscriptHandler emits a bash script that replays the current streams
+// through the HTML form.
+//
+// Deprecated: fragile (greps the CSRF token out of the form) and can't
+// express updates or deletes. Use GET /export and POST /import instead.
 func DumpscriptHandler(store *Store) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		store.RLock()
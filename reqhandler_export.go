@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/voc/rtmp-auth/storage"
+)
+
+// exportStream is the structured (YAML/JSON) representation of a
+// storage.Stream used by /export and /import, replacing the bash
+// dumpscript which can only replay adds and not express updates or
+// deletes.
+type exportStream struct {
+	Id          string `json:"id" yaml:"id"`
+	Application string `json:"application" yaml:"application"`
+	Name        string `json:"name" yaml:"name"`
+	AuthKey     string `json:"auth_key" yaml:"auth_key"`
+	AuthExpire  string `json:"auth_expire" yaml:"auth_expire"`
+	Blocked     bool   `json:"blocked" yaml:"blocked"`
+	Notes       string `json:"notes" yaml:"notes"`
+}
+
+func toExportStream(stream *storage.Stream) exportStream {
+	return exportStream{
+		Id:          stream.Id,
+		Application: stream.Application,
+		Name:        stream.Name,
+		AuthKey:     stream.AuthKey,
+		AuthExpire:  formatAuthExpire(stream.AuthExpire),
+		Blocked:     stream.Blocked,
+		Notes:       stream.Notes,
+	}
+}
+
+func fromExportStream(s exportStream) (*storage.Stream, error) {
+	expiry := parseAuthExpire(s.AuthExpire)
+	if expiry == nil {
+		return nil, fmt.Errorf("Invalid auth_expire: '%v'", s.AuthExpire)
+	}
+	return &storage.Stream{
+		Id:          s.Id,
+		Application: s.Application,
+		Name:        s.Name,
+		AuthKey:     s.AuthKey,
+		AuthExpire:  *expiry,
+		Blocked:     s.Blocked,
+		Notes:       s.Notes,
+	}, nil
+}
+
+// ExportHandler handles GET /export?format=yaml|json, dumping the full
+// stream list as structured data.
+func ExportHandler(store *Store) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "yaml"
+		}
+
+		s := store.Get()
+		streams := make([]exportStream, 0, len(s.State.Streams))
+		for _, stream := range s.State.Streams {
+			streams = append(streams, toExportStream(stream))
+		}
+
+		switch format {
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(streams)
+		case "yaml":
+			w.Header().Set("Content-Type", "application/yaml")
+			out, err := yaml.Marshal(streams)
+			if err != nil {
+				log.Println("ExportHandler: Failed to encode streams", err)
+				http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			w.Write(out)
+		default:
+			http.Error(w, "400 Bad Request: unknown format", http.StatusBadRequest)
+		}
+	}
+}
+
+// ImportHandler handles POST /import?prune=true, reconciling the store
+// with the uploaded document: streams matching by id are updated, new
+// entries are created, and (if prune=true) entries missing from the
+// document are deleted.
+func ImportHandler(store *Store) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "yaml"
+		}
+		prune, _ := strconv.ParseBool(r.URL.Query().Get("prune"))
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		var docs []exportStream
+		switch format {
+		case "json":
+			err = json.Unmarshal(body, &docs)
+		case "yaml":
+			err = yaml.Unmarshal(body, &docs)
+		default:
+			http.Error(w, "400 Bad Request: unknown format", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("ImportHandler: Failed to parse document", err)
+			http.Error(w, "400 Bad Request: malformed document", http.StatusBadRequest)
+			return
+		}
+
+		streams := make([]*storage.Stream, 0, len(docs))
+		for _, doc := range docs {
+			stream, err := fromExportStream(doc)
+			if err != nil {
+				log.Println("ImportHandler:", err)
+				http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			streams = append(streams, stream)
+		}
+
+		if err := store.Reconcile(streams, prune); err != nil {
+			log.Println("ImportHandler: Reconcile failed", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Import reconciled %v streams (prune=%v)\n", len(streams), prune)
+		w.WriteHeader(http.StatusOK)
+	}
+}
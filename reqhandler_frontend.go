@@ -63,7 +63,9 @@ func AddHandler(store *Store) handleFunc {
 				errs = append(errs, fmt.Errorf("Failed to add stream."))
 				log.Printf("AddHandler: Failed to add stream. %v", err)
 			} else {
-				log.Println("New stream added:", stream)
+				log.Printf("New stream added: %v by %v", stream, logUser(r))
+				logEvent("stream_added", stream.Application, stream.Name, stream.Id, r, "")
+				dispatchWebhook("stream_added", stream.Application, stream.Name, stream.Id, "")
 				// log.Println("Store add", stream, store.State)
 			}
 		}
@@ -115,7 +117,9 @@ func RemoveHandler(store *Store) handleFunc {
 			} else {
 				// TODO: var stream is dangling at this point
 				// check what to do... stream = nil?
-				log.Printf("Removed stream %v (%v/%v)", id, app, name)
+				log.Printf("Removed stream %v (%v/%v) by %v", id, app, name, logUser(r))
+				logEvent("stream_removed", app, name, id, r, "")
+				dispatchWebhook("stream_removed", app, name, id, "")
 			}
 		}
 
@@ -166,7 +170,9 @@ func BlockHandler(store *Store) handleFunc {
 						}
 					}
 				}
-				log.Printf("Stream %v (%v/%v) %ved", id, app, name, action)
+				log.Printf("Stream %v (%v/%v) %ved by %v", id, app, name, action, logUser(r))
+				logEvent("stream_blocked", app, name, id, r, action)
+				dispatchWebhook("stream_blocked", app, name, id, action)
 			}
 		}
 
@@ -1,15 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"math/rand"
-	"os"
 	"sync"
 	"time"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/google/uuid"
 
 	"github.com/voc/rtmp-auth/storage"
@@ -18,24 +15,43 @@ import (
 type Store struct {
 	State        storage.State
 	Applications []string
-	Path         string
 	Prefix       string
+	backend      Backend
 	sync.RWMutex
 }
 
-func NewStore(path string, apps []string, prefix string) (*Store, error) {
-	store := &Store{Path: path, Applications: apps, Prefix: prefix}
-	if err := store.read(); err != nil {
+// NewStore opens the persistence backend described by storageDSN (see
+// NewBackend) and loads its state.
+func NewStore(storageDSN string, apps []string, prefix string) (*Store, error) {
+	backend, err := NewBackend(storageDSN)
+	if err != nil {
 		return nil, err
 	}
 
-	if len(store.State.Secret) == 0 {
-		store.State.Secret = make([]byte, 32)
-		rand.Read(store.State.Secret)
-		store.save()
+	state, err := backend.Load()
+	if err != nil {
+		return nil, err
 	}
 
-	return store, nil
+	return &Store{State: state, Applications: apps, Prefix: prefix, backend: backend}, nil
+}
+
+// closer is implemented by backends that hold an open handle (e.g. a
+// sqliteBackend's *sql.DB) needing an explicit flush/close on shutdown.
+type closer interface {
+	Close() error
+}
+
+// Close flushes and releases the backend, if it supports closing.
+func (store *Store) Close() error {
+	store.RLock()
+	backend := store.backend
+	store.RUnlock()
+
+	if c, ok := backend.(closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 type authError struct {
@@ -136,11 +152,10 @@ func (store *Store) SetActive(id string) error {
 	for _, stream := range store.State.Streams {
 		if stream.Id == id {
 			stream.Active = true
-			if err := store.save(); err != nil {
+			if err := store.backend.SetActive(id, true); err != nil {
 				return fmt.Errorf("Couldn't save active state for Stream %v (%v/%v)", id, stream.Application, stream.Name)
-			} else {
-				return nil
 			}
+			return nil
 		}
 	}
 	return fmt.Errorf("SetActive failed: Stream id %v not found.", id)
@@ -155,6 +170,9 @@ func (store *Store) SetInactive(app string, name string) error {
 	for _, stream := range store.State.Streams {
 		if stream.Application == app && stream.Name == name && stream.Active == true {
 			stream.Active = false
+			if err := store.backend.SetActive(stream.Id, false); err != nil {
+				return fmt.Errorf("Couldn't save inactive state for %v/%v", app, name)
+			}
 			stateChange = true
 		}
 	}
@@ -162,10 +180,6 @@ func (store *Store) SetInactive(app string, name string) error {
 		return fmt.Errorf("SetInactive: Couldn't find active steams for %v/%v", app, name)
 	}
 
-	if err := store.save(); err != nil {
-		return fmt.Errorf("Couldn't save inactive state for %v/%v", app, name)
-	}
-
 	return nil
 }
 
@@ -177,15 +191,56 @@ func (store *Store) SetBlocked(id string, state bool) error {
 	for _, stream := range store.State.Streams {
 		if stream.Id == id {
 			stream.Blocked = state
-			if err := store.save(); err != nil {
-				return err
-			}
-			return nil
+			return store.backend.SetBlocked(id, state)
 		}
 	}
 	return nil
 }
 
+// ValidApiToken returns true if token matches one of the configured
+// State.ApiTokens. Used to gate the /api/v1 endpoints instead of CSRF.
+func (store *Store) ValidApiToken(token string) bool {
+	store.RLock()
+	defer store.RUnlock()
+
+	if token == "" {
+		return false
+	}
+	for _, t := range store.State.ApiTokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateStream partially updates a stream's notes, auth expiry and/or
+// blocked state, leaving any nil fields unchanged. It returns the updated
+// stream or an error if the id is not found.
+func (store *Store) UpdateStream(id string, notes *string, authExpire *int64, blocked *bool) (*storage.Stream, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, stream := range store.State.Streams {
+		if stream.Id == id {
+			if notes != nil {
+				stream.Notes = *notes
+			}
+			if authExpire != nil {
+				stream.AuthExpire = *authExpire
+			}
+			if blocked != nil {
+				stream.Blocked = *blocked
+			}
+			if err := store.backend.UpsertStream(stream); err != nil {
+				return nil, fmt.Errorf("Couldn't save updated state for Stream %v (%v/%v)", id, stream.Application, stream.Name)
+			}
+			return stream, nil
+		}
+	}
+	return nil, fmt.Errorf("UpdateStream failed: Stream id %v not found.", id)
+}
+
 func (store *Store) AddStream(stream *storage.Stream) error {
 	store.Lock()
 	defer store.Unlock()
@@ -198,7 +253,7 @@ func (store *Store) AddStream(stream *storage.Stream) error {
 	stream.Id = id.String()
 	store.State.Streams = append(store.State.Streams, stream)
 
-	if err := store.save(); err != nil {
+	if err := store.backend.UpsertStream(stream); err != nil {
 		return err
 	}
 
@@ -211,7 +266,22 @@ func (store *Store) SetCtrlUrl(url string) error {
 
 	store.State.CtrlUrl = url
 
-	if err := store.save(); err != nil {
+	if err := store.backend.SetCtrlUrl(url); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetApiTokens replaces the set of bearer tokens ValidApiToken accepts for
+// the /api/v1 JSON API, persisting them so they survive a restart.
+func (store *Store) SetApiTokens(tokens []string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	store.State.ApiTokens = tokens
+
+	if err := store.backend.SetApiTokens(tokens); err != nil {
 		return err
 	}
 
@@ -239,30 +309,122 @@ func (store *Store) RemoveStream(id string) error {
 		store.State.Streams = s[:len(s)-1] // Truncate slice
 	}
 
-	if err := store.save(); err != nil {
+	if err := store.backend.DeleteStream(id); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// Reconcile replaces the store contents with streams: entries matching an
+// existing id are updated in place, entries with an unknown (or empty) id
+// are created, and existing streams missing from streams are deleted if
+// prune is set. Used by ImportHandler.
+//
+// If a backend write fails partway through, Reconcile undoes the writes it
+// already applied (restoring the prior stream or removing a just-created
+// one) before returning, so a failed import doesn't leave the backend
+// ahead of the in-memory state. This is a best-effort compensating
+// rollback built from the existing Backend methods, not a real backend
+// transaction - if an undo step itself fails, it's logged and only the
+// original error is returned.
+func (store *Store) Reconcile(streams []*storage.Stream, prune bool) error {
+	store.Lock()
+	defer store.Unlock()
+
+	existing := make(map[string]*storage.Stream, len(store.State.Streams))
+	for _, s := range store.State.Streams {
+		existing[s.Id] = s
+	}
+
+	seen := make(map[string]bool, len(streams))
+	result := make([]*storage.Stream, 0, len(streams))
+
+	var undo []func() error
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				log.Printf("Reconcile: failed to roll back a partially applied import: %v", err)
+			}
+		}
+	}
+
+	for _, incoming := range streams {
+		prior, existed := existing[incoming.Id]
+		if !existed {
+			id, err := uuid.NewUUID()
+			if err != nil {
+				rollback()
+				return err
+			}
+			incoming.Id = id.String()
+		}
+
+		if err := store.backend.UpsertStream(incoming); err != nil {
+			rollback()
+			return fmt.Errorf("Reconcile: failed to save stream %v (%v/%v): %v",
+				incoming.Id, incoming.Application, incoming.Name, err)
+		}
+		id := incoming.Id
+		if existed {
+			undo = append(undo, func() error { return store.backend.UpsertStream(prior) })
+		} else {
+			undo = append(undo, func() error { return store.backend.DeleteStream(id) })
+		}
+		seen[incoming.Id] = true
+		result = append(result, incoming)
+	}
+
+	for id, s := range existing {
+		if seen[id] {
+			continue
+		}
+		if !prune {
+			result = append(result, s)
+			continue
+		}
+		if err := store.backend.DeleteStream(id); err != nil {
+			rollback()
+			return fmt.Errorf("Reconcile: failed to delete stream %v: %v", id, err)
+		}
+		stream := s
+		undo = append(undo, func() error { return store.backend.UpsertStream(stream) })
+	}
+
+	store.State.Streams = result
+	return nil
+}
+
 // Expire old streams
 func (store *Store) Expire() {
-	var toDelete []string
+	var toDelete []*storage.Stream
 	now := time.Now().Unix()
 
 	store.RLock()
 	for _, stream := range store.State.Streams {
 		if stream.AuthExpire != -1 && stream.AuthExpire < now {
 			log.Printf("Expiring %s/%s\n", stream.Application, stream.Name)
-			toDelete = append(toDelete, stream.Id)
+			toDelete = append(toDelete, stream)
 		}
 	}
 	store.RUnlock()
 
-	for _, id := range toDelete {
-		DropStreamPublisher(store, id)
+	for _, stream := range toDelete {
+		id := stream.Id
+		// If a drop request to nginx failed or was skipped because the
+		// circuit breaker is open, leave the stream for the next tick
+		// instead of removing a stream whose publisher may still be live.
+		// Streams that are not active, or with no control URL set, are
+		// removed without a drop request.
+		if err := ReqDropStreamPublisher(store, id); err != nil {
+			var e *nginxControlError
+			if errors.As(err, &e) && (e.RequestSent || e.CircuitOpen) {
+				log.Printf("Expire: Failed to drop publisher for stream %v, will retry. %v", id, err)
+				continue
+			}
+		}
 		store.RemoveStream(id)
+		dispatchWebhook("stream_removed", stream.Application, stream.Name, id, "expired")
 	}
 }
 
@@ -271,40 +433,3 @@ func (store *Store) Get() Store {
 	defer store.RUnlock()
 	return *store
 }
-
-// Read parses the store state from a file
-func (store *Store) read() error {
-	store.Lock()
-	defer store.Unlock()
-	data, err := ioutil.ReadFile(store.Path)
-	if err != nil {
-		// Non-existing state is ok
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return fmt.Errorf("No previous file read: %v", err)
-	}
-	if err := proto.Unmarshal(data, &store.State); err != nil {
-		return fmt.Errorf("Failed to parse stream state: %v", err)
-	}
-	log.Println("State restored from", store.Path)
-	return nil
-}
-
-// Save stores the store state in a file
-// Requires Lock
-func (store *Store) save() error {
-	out, err := proto.Marshal(&store.State)
-	if err != nil {
-		return fmt.Errorf("Failed to encode state: %v", err)
-	}
-	tmp := fmt.Sprintf(store.Path+".%v", time.Now())
-	if err := ioutil.WriteFile(tmp, out, 0600); err != nil {
-		return fmt.Errorf("Failed to write state: %v", err)
-	}
-	err = os.Rename(tmp, store.Path)
-	if err != nil {
-		return fmt.Errorf("Failed to move state: %v", err)
-	}
-	return nil
-}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/voc/rtmp-auth/storage"
+)
+
+// memBackend is defined in lease_test.go and reused here.
+
+func TestReconcileAddsAndUpdates(t *testing.T) {
+	backend := newMemBackend()
+	existing := &storage.Stream{Id: "s1", Application: "live", Name: "foo", Notes: "old"}
+	backend.streams["s1"] = existing
+	store := &Store{State: storage.State{Streams: []*storage.Stream{existing}}, backend: backend}
+
+	incoming := []*storage.Stream{
+		{Id: "s1", Application: "live", Name: "foo", Notes: "new"},
+		{Application: "live", Name: "bar", Notes: "brand new"},
+	}
+
+	if err := store.Reconcile(incoming, false); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+
+	if len(store.State.Streams) != 2 {
+		t.Fatalf("expected 2 streams after reconcile, got %d", len(store.State.Streams))
+	}
+	if backend.streams["s1"].Notes != "new" {
+		t.Fatalf("expected s1 to be updated in the backend, got %+v", backend.streams["s1"])
+	}
+	if incoming[1].Id == "" {
+		t.Fatal("expected a fresh id to be assigned to the new stream")
+	}
+	if _, ok := backend.streams[incoming[1].Id]; !ok {
+		t.Fatal("expected the new stream to be persisted to the backend")
+	}
+}
+
+func TestReconcilePrune(t *testing.T) {
+	backend := newMemBackend()
+	kept := &storage.Stream{Id: "keep", Application: "live", Name: "a"}
+	dropped := &storage.Stream{Id: "drop", Application: "live", Name: "b"}
+	backend.streams["keep"] = kept
+	backend.streams["drop"] = dropped
+	store := &Store{State: storage.State{Streams: []*storage.Stream{kept, dropped}}, backend: backend}
+
+	incoming := []*storage.Stream{{Id: "keep", Application: "live", Name: "a"}}
+	if err := store.Reconcile(incoming, true); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+
+	if len(store.State.Streams) != 1 || store.State.Streams[0].Id != "keep" {
+		t.Fatalf("expected only 'keep' to survive prune, got %+v", store.State.Streams)
+	}
+	if _, ok := backend.streams["drop"]; ok {
+		t.Fatal("expected 'drop' to be deleted from the backend")
+	}
+}
+
+func TestReconcileRollsBackOnBackendFailure(t *testing.T) {
+	backend := newMemBackend()
+	existing := &storage.Stream{Id: "s1", Application: "live", Name: "foo", Notes: "old"}
+	backend.streams["s1"] = existing
+	backend.failAfter = 2 // let the update to s1 succeed, fail the new stream's insert
+	store := &Store{State: storage.State{Streams: []*storage.Stream{existing}}, backend: backend}
+
+	incoming := []*storage.Stream{
+		{Id: "s1", Application: "live", Name: "foo", Notes: "new"},
+		{Application: "live", Name: "bar", Notes: "brand new"},
+	}
+
+	if err := store.Reconcile(incoming, false); err == nil {
+		t.Fatal("expected Reconcile to fail when a backend write fails")
+	}
+
+	if len(store.State.Streams) != 1 || store.State.Streams[0].Notes != "old" {
+		t.Fatalf("in-memory state should be untouched on failure, got %+v", store.State.Streams)
+	}
+	if backend.streams["s1"].Notes != "old" {
+		t.Fatalf("expected s1's backend write to be rolled back, got %+v", backend.streams["s1"])
+	}
+}
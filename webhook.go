@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// webhooks is the package-wide dispatcher set up in main() when -webhookURL
+// is configured. Left nil (a no-op) otherwise.
+var webhooks *WebhookDispatcher
+
+// dispatchWebhook notifies webhooks of a stream lifecycle event, a no-op if
+// -webhookURL wasn't configured.
+func dispatchWebhook(event, app, name, streamId, reason string) {
+	webhooks.Dispatch(event, app, name, streamId, reason)
+}
+
+// webhookQueueSize bounds how many pending events a slow endpoint can make
+// the dispatcher buffer before Dispatch starts dropping events rather than
+// blocking the caller (publish/unpublish latency must not depend on a
+// webhook endpoint's responsiveness).
+const webhookQueueSize = 256
+
+// webhookPayload is the JSON body POSTed to each configured webhook URL.
+type webhookPayload struct {
+	Event     string `json:"event"`
+	StreamId  string `json:"stream_id"`
+	App       string `json:"app"`
+	Name      string `json:"name"`
+	Timestamp int64  `json:"timestamp"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// WebhookDispatcher POSTs signed JSON payloads to a set of URLs whenever a
+// stream lifecycle event occurs, via a bounded pool of workers so a slow or
+// unreachable endpoint can't block the caller.
+type WebhookDispatcher struct {
+	urls        []string
+	secret      []byte
+	client      *http.Client
+	maxAttempts int
+	baseDelay   time.Duration
+	queue       chan webhookPayload
+}
+
+// NewWebhookDispatcher starts workers goroutines delivering events to urls,
+// HMAC-SHA256 signed with secret.
+func NewWebhookDispatcher(urls []string, secret string, workers int) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		urls:        urls,
+		secret:      []byte(secret),
+		client:      &http.Client{Timeout: 5 * time.Second},
+		maxAttempts: 4,
+		baseDelay:   200 * time.Millisecond,
+		queue:       make(chan webhookPayload, webhookQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go d.worker()
+	}
+	return d
+}
+
+// Dispatch queues event for delivery, dropping it (with a log line) instead
+// of blocking the caller if the queue is full.
+func (d *WebhookDispatcher) Dispatch(event, app, name, streamId, reason string) {
+	if d == nil {
+		return
+	}
+
+	payload := webhookPayload{
+		Event:     event,
+		StreamId:  streamId,
+		App:       app,
+		Name:      name,
+		Timestamp: time.Now().Unix(),
+		Reason:    reason,
+	}
+
+	select {
+	case d.queue <- payload:
+	default:
+		log.Printf("WebhookDispatcher: queue full, dropping %v event for %v/%v", event, app, name)
+	}
+}
+
+func (d *WebhookDispatcher) worker() {
+	for payload := range d.queue {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Println("WebhookDispatcher: failed to marshal payload", err)
+			continue
+		}
+		signature := d.sign(body)
+
+		for _, url := range d.urls {
+			if err := d.deliver(url, body, signature); err != nil {
+				log.Printf("WebhookDispatcher: giving up delivering %v event to %v: %v", payload.Event, url, err)
+			}
+		}
+	}
+}
+
+func (d *WebhookDispatcher) sign(body []byte) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver POSTs body to url, retrying with exponential backoff and jitter
+// on non-2xx responses or transport errors.
+func (d *WebhookDispatcher) deliver(url string, body []byte, signature string) error {
+	var lastErr error
+
+	for attempt := 0; attempt < d.maxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := d.baseDelay * time.Duration(1<<uint(attempt-1))
+			delay += time.Duration(rand.Int63n(int64(d.baseDelay)))
+			time.Sleep(delay)
+		}
+
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-RtmpAuth-Signature", "sha256="+signature)
+
+		resp, err := d.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	return lastErr
+}